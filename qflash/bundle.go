@@ -0,0 +1,174 @@
+package qflash
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"fmt"
+
+	"zappem.net/pub/debug/xcrc32"
+)
+
+// bundleMagic identifies a qftool image bundle (a ".qfimage" file).
+const bundleMagic = "QFIMAGE1"
+
+// bundleVersion is the only bundle format version this package
+// knows how to read and write.
+const bundleVersion = 1
+
+// bundleHeader is the fixed-size header of a .qfimage bundle,
+// followed by Count bundleSection descriptors and then the
+// concatenated, 0x1000-padded section payloads in descriptor order.
+type bundleHeader struct {
+	Magic   [8]byte
+	Version uint32
+	Count   uint32
+	SHA256  [32]byte
+}
+
+// bundleSection describes one section's payload within a bundle.
+type bundleSection struct {
+	Name     [16]byte
+	Base     uint32
+	Size     uint32
+	CRC32    uint32
+	Image    uint8
+	Purpose  uint8
+	Reserved [2]byte
+}
+
+func crc32Of(d []byte) uint32 {
+	_, crc := xcrc32.NewCRC32(d)
+	return crc
+}
+
+// pad4k pads d with 0xff up to the next multiple of 4KiB.
+func pad4k(d []byte) []byte {
+	if len(d)&0xfff == 0 {
+		return d
+	}
+	extend := 0x1000 - (len(d) & 0xfff)
+	out := make([]byte, len(d)+extend)
+	copy(out, d)
+	for i := len(d); i < len(out); i++ {
+		out[i] = 0xff
+	}
+	return out
+}
+
+// DumpBundle reads every section whose metadata marks it as
+// PresentWritten and returns a self-describing .qfimage bundle
+// containing them, in Sections order.
+func (a *QF) DumpBundle() ([]byte, error) {
+	var descs []bundleSection
+	var payload []byte
+	for _, sec := range Sections {
+		m, err := a.ReadMeta(sec)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read metadata for %q: %v", sec.Name, err)
+		}
+		if m.Written != PresentWritten {
+			continue
+		}
+		d, err := a.Read(sec.Base, int(m.Size), false)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read %q: %v", sec.Name, err)
+		}
+		var name [16]byte
+		copy(name[:], sec.Name)
+		descs = append(descs, bundleSection{
+			Name:    name,
+			Base:    uint32(sec.Base),
+			Size:    uint32(len(d)),
+			CRC32:   crc32Of(d),
+			Image:   uint8(sec.Image),
+			Purpose: uint8(sec.Purpose),
+		})
+		payload = append(payload, pad4k(d)...)
+	}
+
+	hdr := bundleHeader{
+		Version: bundleVersion,
+		Count:   uint32(len(descs)),
+		SHA256:  sha256.Sum256(payload),
+	}
+	copy(hdr.Magic[:], bundleMagic)
+
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, hdr); err != nil {
+		return nil, fmt.Errorf("failed to format bundle header: %v", err)
+	}
+	for _, desc := range descs {
+		if err := binary.Write(buf, binary.LittleEndian, desc); err != nil {
+			return nil, fmt.Errorf("failed to format bundle section descriptor: %v", err)
+		}
+	}
+	buf.Write(payload)
+	return buf.Bytes(), nil
+}
+
+// FlashBundle programs every section in a .qfimage bundle (as
+// produced by DumpBundle) in order, refusing to touch any section
+// based below protect, and re-reads each section to confirm its CRC
+// before updating its metadata.
+func (a *QF) FlashBundle(data []byte, protect int) error {
+	r := bytes.NewReader(data)
+	var hdr bundleHeader
+	if err := binary.Read(r, binary.LittleEndian, &hdr); err != nil {
+		return fmt.Errorf("failed to decode bundle header: %v", err)
+	}
+	if string(bytes.TrimRight(hdr.Magic[:], "\x00")) != bundleMagic {
+		return fmt.Errorf("not a qftool image bundle")
+	}
+	if hdr.Version != bundleVersion {
+		return fmt.Errorf("unsupported bundle version %d", hdr.Version)
+	}
+	descs := make([]bundleSection, hdr.Count)
+	if err := binary.Read(r, binary.LittleEndian, &descs); err != nil {
+		return fmt.Errorf("failed to decode bundle section descriptors: %v", err)
+	}
+	payload := data[len(data)-r.Len():]
+	if sum := sha256.Sum256(payload); sum != hdr.SHA256 {
+		return fmt.Errorf("bundle failed its SHA-256 check")
+	}
+
+	offset := 0
+	for _, desc := range descs {
+		name := string(bytes.TrimRight(desc.Name[:], "\x00"))
+		sec, err := SectionByName(name)
+		if err != nil {
+			return fmt.Errorf("bundle references %v", err)
+		}
+		if sec.Base < protect {
+			return fmt.Errorf("section %q falls below protected base 0x%06x: aborting", name, protect)
+		}
+		padded := pad4k(make([]byte, desc.Size))
+		if offset+len(padded) > len(payload) {
+			return fmt.Errorf("bundle truncated: section %q needs %d bytes, only %d remain", name, len(padded), len(payload)-offset)
+		}
+		d := payload[offset : offset+int(desc.Size)]
+		offset += len(padded)
+
+		if err := a.Write(sec.Base, d, false); err != nil {
+			return fmt.Errorf("failed to write section %q: %v", name, err)
+		}
+		crc, err := a.VerifyWrite(sec.Base, d, false)
+		if err != nil {
+			return fmt.Errorf("section %q: %v", name, err)
+		}
+		if crc != desc.CRC32 {
+			return fmt.Errorf("section %q: bundle CRC 0x%08x does not match programmed CRC 0x%08x", name, desc.CRC32, crc)
+		}
+		if err := a.WriteMeta(sec, MetaData{
+			CRC:      crc,
+			Size:     desc.Size,
+			Written:  PresentWritten,
+			Image:    Type(desc.Image),
+			Purpose:  SubType(desc.Purpose),
+			Reserved: 0xff,
+		}); err != nil {
+			return fmt.Errorf("failed to write metadata for %q: %v", name, err)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,247 @@
+package qflash
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+)
+
+// fsMagic identifies an initialized fs config store.
+const fsMagic = "QFCF"
+
+// fsTombstone marks a record as deleting its key rather than
+// setting it, since a real value can never be this long.
+const fsTombstone = 0xffff
+
+// fsRecord is one decoded record of the append-only fs config store.
+type fsRecord struct {
+	key   string
+	value string
+	tomb  bool
+}
+
+// encodeFSRecord formats a {u16 key_len, u16 val_len, key, value}
+// record, using val_len==fsTombstone to mark a deletion.
+func encodeFSRecord(key, value string, tomb bool) ([]byte, error) {
+	if len(key) > 0xffff {
+		return nil, fmt.Errorf("fs: key %q too long", key)
+	}
+	if len(value) >= fsTombstone {
+		return nil, fmt.Errorf("fs: value for %q too long", key)
+	}
+	valLen := uint16(len(value))
+	if tomb {
+		valLen = fsTombstone
+		value = ""
+	}
+	buf := make([]byte, 4+len(key)+len(value))
+	binary.LittleEndian.PutUint16(buf[0:2], uint16(len(key)))
+	binary.LittleEndian.PutUint16(buf[2:4], valLen)
+	copy(buf[4:], key)
+	copy(buf[4+len(key):], value)
+	return buf, nil
+}
+
+// parseFSRecords decodes the records following the fsMagic header in
+// raw, or returns no records if raw is empty (an uninitialized
+// store).
+func parseFSRecords(raw []byte) ([]fsRecord, error) {
+	if len(raw) == 0 {
+		return nil, nil
+	}
+	if len(raw) < len(fsMagic) || string(raw[:len(fsMagic)]) != fsMagic {
+		return nil, fmt.Errorf("fs: bad magic")
+	}
+	var recs []fsRecord
+	p := raw[len(fsMagic):]
+	for len(p) > 0 {
+		if len(p) < 4 {
+			return nil, fmt.Errorf("fs: truncated record header")
+		}
+		keyLen := binary.LittleEndian.Uint16(p[0:2])
+		valLen := binary.LittleEndian.Uint16(p[2:4])
+		p = p[4:]
+		if int(keyLen) > len(p) {
+			return nil, fmt.Errorf("fs: truncated key")
+		}
+		key := string(p[:keyLen])
+		p = p[keyLen:]
+		rec := fsRecord{key: key, tomb: valLen == fsTombstone}
+		if !rec.tomb {
+			if int(valLen) > len(p) {
+				return nil, fmt.Errorf("fs: truncated value")
+			}
+			rec.value = string(p[:valLen])
+			p = p[valLen:]
+		}
+		recs = append(recs, rec)
+	}
+	return recs, nil
+}
+
+// liveFSValues replays recs in order, so later records (including
+// tombstones) override earlier ones for the same key.
+func liveFSValues(recs []fsRecord) map[string]string {
+	live := make(map[string]string, len(recs))
+	for _, r := range recs {
+		if r.tomb {
+			delete(live, r.key)
+			continue
+		}
+		live[r.key] = r.value
+	}
+	return live
+}
+
+// buildFSImage formats a fresh, compacted fs store image holding
+// exactly live, in a deterministic (sorted) key order.
+func buildFSImage(live map[string]string) ([]byte, error) {
+	keys := make([]string, 0, len(live))
+	for k := range live {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	buf := []byte(fsMagic)
+	for _, k := range keys {
+		rec, err := encodeFSRecord(k, live[k], false)
+		if err != nil {
+			return nil, err
+		}
+		buf = append(buf, rec...)
+	}
+	return buf, nil
+}
+
+// readFS returns the fs section and its currently stored raw bytes
+// (nil if the store has never been initialized).
+func (a *QF) readFS() (Section, []byte, error) {
+	sec, err := SectionByName("fs")
+	if err != nil {
+		return sec, nil, err
+	}
+	m, err := a.ReadMeta(sec)
+	if err != nil {
+		return sec, nil, err
+	}
+	if m.Written != PresentWritten || m.Size == 0 {
+		return sec, nil, nil
+	}
+	raw, err := a.Read(sec.Base, int(m.Size), false)
+	if err != nil {
+		return sec, nil, fmt.Errorf("failed to read fs section: %v", err)
+	}
+	return sec, raw, nil
+}
+
+// CfgGet returns the current value of key in the fs config store.
+func (a *QF) CfgGet(key string) (string, bool, error) {
+	_, raw, err := a.readFS()
+	if err != nil {
+		return "", false, err
+	}
+	recs, err := parseFSRecords(raw)
+	if err != nil {
+		return "", false, err
+	}
+	v, ok := liveFSValues(recs)[key]
+	return v, ok, nil
+}
+
+// CfgList returns every live key/value pair in the fs config store.
+func (a *QF) CfgList() (map[string]string, error) {
+	_, raw, err := a.readFS()
+	if err != nil {
+		return nil, err
+	}
+	recs, err := parseFSRecords(raw)
+	if err != nil {
+		return nil, err
+	}
+	return liveFSValues(recs), nil
+}
+
+// fsApply appends a set or delete record for key to the fs store,
+// compacting the store first if there is no room left for it.
+func (a *QF) fsApply(key, value string, tomb bool) error {
+	sec, raw, err := a.readFS()
+	if err != nil {
+		return err
+	}
+	recs, err := parseFSRecords(raw)
+	if err != nil {
+		return err
+	}
+	live := liveFSValues(recs)
+	if tomb {
+		if _, ok := live[key]; !ok {
+			return fmt.Errorf("fs: key %q not set", key)
+		}
+	}
+
+	rec, err := encodeFSRecord(key, value, tomb)
+	if err != nil {
+		return err
+	}
+	initializing := len(raw) == 0
+	if initializing {
+		raw = []byte(fsMagic)
+	}
+
+	capacity := sec.Limit - sec.Base
+	if len(raw)+len(rec) <= capacity {
+		if initializing {
+			if err := a.ProgramBytes(sec.Base, raw, false); err != nil {
+				return fmt.Errorf("failed to initialize fs magic: %v", err)
+			}
+		}
+		if err := a.ProgramBytes(sec.Base+len(raw), rec, false); err != nil {
+			return fmt.Errorf("failed to append fs record: %v", err)
+		}
+		return a.writeFSMeta(sec, append(raw, rec...))
+	}
+
+	// No room left for the new record: compact, folding it in.
+	if tomb {
+		delete(live, key)
+	} else {
+		live[key] = value
+	}
+	compacted, err := buildFSImage(live)
+	if err != nil {
+		return err
+	}
+	if len(compacted) > capacity {
+		return fmt.Errorf("fs: config store full even after compaction")
+	}
+	if err := a.EraseRange(sec.Base, capacity); err != nil {
+		return fmt.Errorf("failed to erase fs section for compaction: %v", err)
+	}
+	if err := a.WriteWithoutErase(sec.Base, compacted, false); err != nil {
+		return fmt.Errorf("failed to rewrite fs section: %v", err)
+	}
+	return a.writeFSMeta(sec, compacted)
+}
+
+// writeFSMeta updates the fs section's metadata to reflect raw now
+// being its live content, so the bootloader's CRC validation (and
+// the next readFS) sees a consistent store.
+func (a *QF) writeFSMeta(sec Section, raw []byte) error {
+	return a.WriteMeta(sec, MetaData{
+		CRC:      crc32Of(raw),
+		Size:     uint32(len(raw)),
+		Written:  PresentWritten,
+		Image:    sec.Image,
+		Purpose:  sec.Purpose,
+		Reserved: 0xff,
+	})
+}
+
+// CfgSet sets key to value in the fs config store.
+func (a *QF) CfgSet(key, value string) error {
+	return a.fsApply(key, value, false)
+}
+
+// CfgDel deletes key from the fs config store.
+func (a *QF) CfgDel(key string) error {
+	return a.fsApply(key, "", true)
+}
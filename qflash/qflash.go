@@ -0,0 +1,958 @@
+// Package qflash drives the SPI ROM of a QuickFeather development
+// board over its TinyFPGA-bootloader USB serial protocol. It is
+// factored out of the qftool command so other Go programs can program
+// or inspect a board without shelling out.
+//
+// The image layout of the 2MiB of SPI ROM is:
+//
+//   0x00000-0x0ffff bootloader (metadata: 0x1f000)
+//   0x20000-0x3ffff usb FPGA (metadata: 0x10000)
+//   0x40000-0x5ffff app FPGA (metadata: 0x11000)
+//   0x60000-0x7ffff app FFE (metadata: 0x12000)
+//   0x80000-0xedfff app M4 code (metadata: 0x13000)
+//   0xee000-0xfffff fs config store (metadata: 0x17000)
+//
+// The metadata captures info like the fact the corresponding section
+// of the flash is occupied and its CRC value. The bootloader
+// validates this CRC before loading and executing a section's
+// content. Errors here tend to cause the bootloader to set the "red"
+// LED to turn on.
+//
+// The "app" region is additionally addressable as two equal A/B OTA
+// update slots, app-a and app-b (metadata: 0x14000 and 0x15000), with
+// a boot manifest at 0x16000 recording the active slot, a pending
+// slot awaiting confirmation and a boot-attempt counter.
+//
+// Caution: driving this package incorrectly can brick a QuickFeather
+// board. See https://forum.quicklogic.com/viewtopic.php?t=29 for ways
+// to recover one; it probably requires a J-Link tool from SEGGER.
+package qflash
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/pkg/term"
+	"zappem.net/pub/debug/xcrc32"
+)
+
+// RomSize is the total addressable size of the SPI ROM.
+const RomSize = 2 * 1024 * 1024
+
+// Reader reads len(p) bytes of flash starting at off, mirroring
+// io.ReaderAt.
+type Reader interface {
+	ReadAt(p []byte, off int64) (int, error)
+}
+
+// Writer programs len(p) bytes of flash starting at off without
+// performing any erase of its own, mirroring io.WriterAt. Callers
+// are responsible for erasing via Eraser first.
+type Writer interface {
+	WriteAt(p []byte, off int64) (int, error)
+}
+
+// Eraser erases flash sectors ahead of programming.
+type Eraser interface {
+	// EraseSector erases the single 4KiB sector starting at addr,
+	// which must be sector aligned.
+	EraseSector(addr int) error
+
+	// EraseRange erases every sector overlapping [addr, addr+n);
+	// addr must be sector aligned.
+	EraseRange(addr, n int) error
+}
+
+type Present uint8
+
+const (
+	PresentWritten Present = 0x03
+	PresentEmpty           = 0xff
+)
+
+func (p Present) String() string {
+	switch p {
+	case PresentWritten:
+		return "written"
+	case PresentEmpty:
+		return "empty"
+	default:
+		return "<error>"
+	}
+}
+
+type Type uint8
+
+const (
+	TypeM4   Type = 1
+	TypeFFE       = 2
+	TypeFPGA      = 3
+	TypeFS        = 4
+)
+
+func (t Type) String() string {
+	switch t {
+	case TypeM4:
+		return "m4"
+	case TypeFFE:
+		return "ffe"
+	case TypeFPGA:
+		return "fpga"
+	case TypeFS:
+		return "fs"
+	default:
+		return "<error>"
+	}
+}
+
+type SubType uint8
+
+const (
+	SubTypeBoot  SubType = 1
+	SubTypeApp           = 2
+	SubTypeOTA           = 3
+	SubTypeFSFat         = 0x20
+)
+
+func (t SubType) String() string {
+	switch t {
+	case SubTypeBoot:
+		return "boot"
+	case SubTypeApp:
+		return "app"
+	case SubTypeOTA:
+		return "ota"
+	case SubTypeFSFat:
+		return "fs-FAT"
+	default:
+		return "<error>"
+	}
+}
+
+// MetaData is the format of the meta data associated with each section.
+type MetaData struct {
+	// CRC is a composable CRC32 value whose computation is common
+	// to the remote protocol for gdb and appears to have its
+	// origins in libiberty/crc32.c
+	CRC uint32
+
+	// Size is the number of bytes written to the flash for the
+	// section described by this metadata.
+	Size uint32
+
+	// Present is a single byte capturing the presence of the desired
+	// object.
+	Written Present
+
+	// Type indicates the encoding.
+	Image Type
+
+	// SubType captures the role of the image in this section.
+	Purpose SubType
+
+	// Reserved holds 0xff
+	Reserved uint8
+}
+
+type Section struct {
+	Name              string
+	Base, Limit, Meta int
+	Written           Present
+	Image             Type
+	Purpose           SubType
+}
+
+// Sections holds the layout map for the flash.
+var Sections = []Section{
+	{
+		Name:    "bootloader",
+		Base:    0x00000,
+		Limit:   0x10000,
+		Meta:    0x1f000,
+		Image:   TypeM4,
+		Purpose: SubTypeBoot,
+	},
+	{
+		Name:    "bootfpga",
+		Base:    0x20000,
+		Limit:   0x40000,
+		Meta:    0x10000,
+		Image:   TypeFPGA,
+		Purpose: SubTypeBoot,
+	},
+	{
+		Name:    "appfpga",
+		Base:    0x40000,
+		Limit:   0x60000,
+		Meta:    0x11000,
+		Image:   TypeFPGA,
+		Purpose: SubTypeApp,
+	},
+	{
+		Name:    "appffe",
+		Base:    0x60000,
+		Limit:   0x80000,
+		Meta:    0x12000,
+		Image:   TypeFFE,
+		Purpose: SubTypeApp,
+	},
+	{
+		Name:    "app",
+		Base:    0x80000,
+		Limit:   0xee000,
+		Meta:    0x13000,
+		Image:   TypeM4,
+		Purpose: SubTypeApp,
+	},
+	{
+		Name:    "fs",
+		Base:    0xee000,
+		Limit:   0x100000,
+		Meta:    0x17000,
+		Image:   TypeFS,
+		Purpose: SubTypeFSFat,
+	},
+}
+
+// SlotA and SlotB index the two OTA application slots; SlotNone
+// marks the absence of a slot (e.g. no pending update).
+const (
+	SlotA    uint8 = 0
+	SlotB    uint8 = 1
+	SlotNone uint8 = 0xff
+)
+
+// MaxBootAttempts is the attempt budget the bootloader is expected
+// to grant the active slot before it falls back to the other one.
+const MaxBootAttempts = 3
+
+// BootManifestAddr is the flash address of the A/B boot manifest.
+const BootManifestAddr = 0x16000
+
+// OTASlots splits the "app" section's address range into two equal
+// halves, each independently programmable and independently
+// validated, for A/B OTA updates.
+var OTASlots = []Section{
+	{
+		Name:    "app-a",
+		Base:    0x80000,
+		Limit:   0xb7000,
+		Meta:    0x14000,
+		Image:   TypeM4,
+		Purpose: SubTypeOTA,
+	},
+	{
+		Name:    "app-b",
+		Base:    0xb7000,
+		Limit:   0xee000,
+		Meta:    0x15000,
+		Image:   TypeM4,
+		Purpose: SubTypeOTA,
+	},
+}
+
+// BootManifest is the format of the A/B boot manifest. The
+// bootloader is expected to boot Active, decrementing Attempts on
+// each failed boot, and to fall back to the other slot once Attempts
+// reaches zero.
+type BootManifest struct {
+	// Version is a monotonic counter incremented each time a new
+	// image is programmed into the inactive slot.
+	Version uint32
+
+	// Active is the slot (SlotA or SlotB) the bootloader should
+	// execute.
+	Active uint8
+
+	// Pending is the slot awaiting Confirm, or SlotNone if no
+	// update is in flight.
+	Pending uint8
+
+	// Attempts counts down the remaining boot attempts for Active.
+	Attempts uint8
+
+	// Reserved holds 0xff.
+	Reserved uint8
+}
+
+// SlotName renders a slot index (or SlotNone) for display.
+func SlotName(idx uint8) string {
+	switch idx {
+	case SlotA:
+		return "app-a"
+	case SlotB:
+		return "app-b"
+	default:
+		return "none"
+	}
+}
+
+// SectionByName returns the section information for the named
+// section.
+func SectionByName(name string) (Section, error) {
+	for _, sec := range Sections {
+		if sec.Name == name {
+			return sec, nil
+		}
+	}
+	return Section{}, fmt.Errorf("no section named %q", name)
+}
+
+// transport is the minimal I/O a QF needs from its connection to the
+// board; *term.Term satisfies it, and tests substitute a mock so the
+// pipelining benchmarks don't need real hardware.
+type transport interface {
+	Write(p []byte) (int, error)
+	Read(p []byte) (int, error)
+}
+
+// defaultPipelineDepth is how many fast-read SPI commands NewQF
+// batches into a single USB transaction, absent a caller override.
+const defaultPipelineDepth = 8
+
+// QF holds an open connection to a QuickFeather USB serial port.
+type QF struct {
+	t      transport
+	closer io.Closer
+	mu     sync.Mutex
+	reader *bufio.Reader
+
+	// Latency is how long to wait for a desired status before
+	// giving up.
+	Latency time.Duration
+
+	// Debug, when true, makes QF log extra diagnostics.
+	Debug bool
+
+	// PipelineDepth bounds how many fast-read SPI commands Read
+	// queues into a single USB write before reading back their
+	// replies. Reads carry no completion state (unlike a
+	// page-program, a fast read never leaves the flash WIP), so
+	// batching them ahead of a single round trip is always safe.
+	PipelineDepth int
+}
+
+// Close closes down the motor control.
+func (a *QF) Close() error {
+	if a.closer == nil {
+		return nil
+	}
+	return a.closer.Close()
+}
+
+// spiRequest is one SPI command awaiting its reply within a
+// pipelined batch.
+type spiRequest struct {
+	cmds   []byte
+	expect uint
+}
+
+// spiPipeline issues multiple SPI requests concatenated into a
+// single underlying USB write, then reads their concatenated replies
+// back in a single read, returning one reply per request in order.
+// The protocol already length-prefixes each command with its
+// expected reply size, so several [header|cmds] blocks can be sent
+// back to back without waiting on a reply in between.
+func (a *QF) spiPipeline(reqs []spiRequest) ([][]byte, error) {
+	var buf []byte
+	total := uint(0)
+	for _, r := range reqs {
+		if r.expect > 16 || len(r.cmds) > 16 {
+			return nil, fmt.Errorf("protocol limited to 16 byte payloads")
+		}
+		head := make([]byte, 5)
+		head[0] = 1
+		send := uint(len(r.cmds))
+		head[1] = byte(send & 0xff)
+		head[2] = byte((send >> 8) & 0xff)
+		head[3] = byte(r.expect & 0xff)
+		head[4] = byte((r.expect >> 8) & 0xff)
+		buf = append(buf, head...)
+		buf = append(buf, r.cmds...)
+		total += r.expect
+	}
+	if n, err := a.t.Write(buf); err != nil {
+		return nil, fmt.Errorf("failed to write enough [%d != %d]: %v", n, len(buf), err)
+	}
+	resp := make([]byte, total)
+	consumed := uint(0)
+	for consumed != total {
+		n, err := a.t.Read(resp[consumed:total])
+		if n == 0 && err != nil {
+			return nil, fmt.Errorf("failed to read IDs [just %d bytes]: %v", consumed+uint(n), err)
+		}
+		consumed += uint(n)
+	}
+	out := make([][]byte, len(reqs))
+	off := uint(0)
+	for i, r := range reqs {
+		out[i] = resp[off : off+r.expect]
+		off += r.expect
+	}
+	return out, nil
+}
+
+// spi performs a single SPI command using the TinyFPGA bootloader protocol.
+func (a *QF) spi(cmds []byte, expect uint) ([]byte, error) {
+	out, err := a.spiPipeline([]spiRequest{{cmds: cmds, expect: expect}})
+	if err != nil {
+		return nil, err
+	}
+	return out[0], nil
+}
+
+var ErrTimedOut = errors.New("timed out")
+
+// await polls the status register until masked by mask, it equals desired.
+func (a *QF) await(mask, desired byte, timeout time.Duration) error {
+	if timeout == 0 {
+		timeout = a.Latency
+	}
+	until := time.After(timeout)
+	for {
+		if b, err := a.spi([]byte{0x05}, 1); err != nil {
+			return fmt.Errorf("failed to read status: %v", err)
+		} else if b[0]&mask == desired {
+			return nil
+		}
+		select {
+		case <-time.After(10 * time.Millisecond):
+		case <-until:
+			return ErrTimedOut
+		}
+	}
+}
+
+const flashWIP = 1 << 0
+
+var ErrWriteEnableFailed = errors.New("write enabled failed")
+
+func (a *QF) writeEnable() error {
+	if _, err := a.spi([]byte{0x06}, 0); err != nil {
+		return ErrWriteEnableFailed
+	}
+	return nil
+}
+
+// Read reads n bytes from a specific address returning a byte array.
+// Up to PipelineDepth fast-read commands are batched into a single
+// USB write, since unlike a page-program a fast read has no
+// in-progress state to wait on between commands.
+func (a *QF) Read(address, n int, ticker bool) ([]byte, error) {
+	var result []byte
+	tics := n / 50
+	sofar := 0
+	if ticker {
+		fmt.Printf("read [0x%06x,0x%06x] ", address, address+n-1)
+	}
+	if address < 0 || address+n > RomSize {
+		return nil, fmt.Errorf("data read request outside [0x%x,0x%x)", 0, RomSize)
+	}
+	depth := a.PipelineDepth
+	if depth < 1 {
+		depth = 1
+	}
+	for n > 0 {
+		var reqs []spiRequest
+		deltas := make([]int, 0, depth)
+		for len(reqs) < depth && n > 0 {
+			cmd := make([]byte, 5)
+			cmd[0] = 0x0B
+			cmd[1] = byte((address >> 16) & 0xFF)
+			cmd[2] = byte((address >> 8) & 0xFF)
+			cmd[3] = byte(address & 0xFF)
+			offset := address & 15
+			delta := 16 - offset
+			if delta > n {
+				delta = n
+			}
+			reqs = append(reqs, spiRequest{cmds: cmd, expect: uint(delta)})
+			deltas = append(deltas, delta)
+			address += delta
+			n -= delta
+		}
+		replies, err := a.spiPipeline(reqs)
+		if err != nil {
+			return nil, err
+		}
+		for i, d := range replies {
+			result = append(result, d...)
+			sofar += deltas[i]
+		}
+		if ticker {
+			for sofar >= tics && tics > 0 {
+				fmt.Print(".")
+				sofar -= tics
+			}
+		}
+	}
+	if ticker {
+		fmt.Println(" done")
+	}
+	return result, nil
+}
+
+// ReadAt implements Reader, reading len(p) bytes from off into p.
+func (a *QF) ReadAt(p []byte, off int64) (int, error) {
+	d, err := a.Read(int(off), len(p), false)
+	if err != nil {
+		return 0, err
+	}
+	copy(p, d)
+	return len(d), nil
+}
+
+// EraseSector erases the 4KiB sector starting at addr, returning an
+// error if addr is not sector aligned.
+func (a *QF) EraseSector(addr int) error {
+	if addr&0xfff != 0 {
+		return fmt.Errorf("address is not sector aligned: 0x%06x & 0xfff != 0", addr)
+	}
+	cmd := []byte{0x20, byte((addr >> 16) & 0xFF), byte((addr >> 8) & 0xFF), byte(addr & 0xFF)}
+	if err := a.writeEnable(); err != nil {
+		return fmt.Errorf("sector erase at address=0x%06x: %v", addr, err)
+	}
+	if _, err := a.spi(cmd, 0); err != nil {
+		return fmt.Errorf("sector erase failed for address=0x%06x: %v", addr, err)
+	}
+	return a.await(flashWIP, 0, a.Latency)
+}
+
+// eraseBlock erases the aligned block at addr using cmd, which must
+// be either a 32KiB (0x52) or 64KiB (0xD8) block-erase command.
+func (a *QF) eraseBlock(cmd byte, addr int) error {
+	req := []byte{cmd, byte((addr >> 16) & 0xFF), byte((addr >> 8) & 0xFF), byte(addr & 0xFF)}
+	if err := a.writeEnable(); err != nil {
+		return fmt.Errorf("block erase at address=0x%06x: %v", addr, err)
+	}
+	if _, err := a.spi(req, 0); err != nil {
+		return fmt.Errorf("block erase failed for address=0x%06x: %v", addr, err)
+	}
+	return a.await(flashWIP, 0, a.Latency)
+}
+
+// EraseRange erases every sector overlapping [addr, addr+n), using
+// the MX25's 64KiB (0xD8) and 32KiB (0x52) block-erase commands
+// where the range is aligned widely enough, and its 4KiB (0x20)
+// sector erase otherwise. addr must be sector aligned; n need not be.
+func (a *QF) EraseRange(addr, n int) error {
+	if addr&0xfff != 0 {
+		return fmt.Errorf("address is not sector aligned: 0x%06x & 0xfff != 0", addr)
+	}
+	end := addr + n
+	for addr < end {
+		switch {
+		case addr&0xffff == 0 && addr+0x10000 <= end:
+			if err := a.eraseBlock(0xD8, addr); err != nil {
+				return err
+			}
+			addr += 0x10000
+		case addr&0x7fff == 0 && addr+0x8000 <= end:
+			if err := a.eraseBlock(0x52, addr); err != nil {
+				return err
+			}
+			addr += 0x8000
+		default:
+			if err := a.EraseSector(addr); err != nil {
+				return err
+			}
+			addr += 0x1000
+		}
+	}
+	return nil
+}
+
+// WriteWithoutErase programs data at address without erasing
+// first; callers must ensure the target range is already erased,
+// e.g. via EraseRange.
+func (a *QF) WriteWithoutErase(address int, data []byte, ticker bool) error {
+	if address&0xfff != 0 {
+		return fmt.Errorf("address is not sector aligned: 0x%06x & 0xfff != 0", address)
+	}
+	return a.ProgramBytes(address, pad4k(data), ticker)
+}
+
+// maxProgramChunk is the most data a single page-program SPI command
+// can carry: the USB protocol caps a command at 16 bytes and the
+// opcode+address header takes 4 of those, leaving 12. The MX25 page
+// program command itself supports a full 256-byte page in one SPI
+// transaction, but this board's TinyFPGA-bootloader transport has no
+// way to carry that much payload in a single command.
+const maxProgramChunk = 12
+
+// ProgramBytes issues raw page-program commands to write data
+// starting at address, assuming the destination is already erased.
+// Unlike WriteWithoutErase, address need not be sector-aligned and
+// data is not padded to a sector boundary, so it is suitable for
+// appending records mid-sector (see the fs config store).
+//
+// Each page-program's WREN and program command are combined into a
+// single USB round trip, but status is polled for WIP=0 before the
+// next WREN is issued: real MX25 NOR flash ignores WREN while a
+// program is still in progress, so queuing several WREN+program
+// pairs ahead of a single aggregate poll would silently drop every
+// program after the first. PipelineDepth batching is only safe for
+// commands without this completion dependency (see Read).
+func (a *QF) ProgramBytes(address int, data []byte, ticker bool) error {
+	offset := 0
+	n := len(data)
+	tics := n / 50
+	sofar := 0
+	if ticker {
+		fmt.Printf("write [0x%06x,0x%06x] ", address, address+n-1)
+	}
+	if address < 0 || address+n > RomSize {
+		return fmt.Errorf("data write request outside [0x%x,0x%x)", 0, RomSize)
+	}
+	for n > 0 {
+		delta := n
+		if pageRemaining := 256 - (address % 256); delta > pageRemaining {
+			delta = pageRemaining
+		}
+		if delta > maxProgramChunk {
+			delta = maxProgramChunk
+		}
+		cmd := make([]byte, 4, 4+delta)
+		cmd[0] = 0x02
+		cmd[1] = byte((address >> 16) & 0xFF)
+		cmd[2] = byte((address >> 8) & 0xFF)
+		cmd[3] = byte(address & 0xFF)
+		cmd = append(cmd, data[offset:offset+delta]...)
+		if _, err := a.spiPipeline([]spiRequest{{cmds: []byte{0x06}}, {cmds: cmd}}); err != nil {
+			return fmt.Errorf("write enable/program pipeline failed address=0x%06x: %v", address, err)
+		}
+		if err := a.await(flashWIP, 0, a.Latency); err != nil {
+			return fmt.Errorf("page program error: %v", err)
+		}
+		address += delta
+		offset += delta
+		n -= delta
+		sofar += delta
+		if ticker {
+			for sofar >= tics && tics > 0 {
+				fmt.Print(".")
+				sofar -= tics
+			}
+		}
+	}
+	if ticker {
+		fmt.Println(" done")
+	}
+	return nil
+}
+
+// Write erases the sectors covering data's destination and then
+// programs data at address.
+func (a *QF) Write(address int, data []byte, ticker bool) error {
+	if address&0xfff != 0 {
+		return fmt.Errorf("address is not sector aligned: 0x%06x & 0xfff != 0", address)
+	}
+	n := len(data)
+	if n&0xfff != 0 {
+		n += 0x1000 - (n & 0xfff)
+	}
+	if err := a.EraseRange(address, n); err != nil {
+		return err
+	}
+	return a.WriteWithoutErase(address, data, ticker)
+}
+
+// WriteAt implements Writer, programming p at off without erasing.
+func (a *QF) WriteAt(p []byte, off int64) (int, error) {
+	if err := a.WriteWithoutErase(int(off), p, false); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// SectorsFor returns the base address of each 4KiB sector
+// overlapping [addr, addr+n).
+func SectorsFor(addr, n int) []int {
+	start := addr &^ 0xfff
+	end := addr + n
+	var out []int
+	for s := start; s < end; s += 0x1000 {
+		out = append(out, s)
+	}
+	return out
+}
+
+// VerifyWrite reads back len(data) bytes from addr and confirms its
+// CRC32 matches data's, returning the confirmed CRC on success. It
+// does not touch any metadata.
+func (a *QF) VerifyWrite(addr int, data []byte, ticker bool) (uint32, error) {
+	readBack, err := a.Read(addr, len(data), ticker)
+	if err != nil {
+		return 0, fmt.Errorf("failed to read back [0x%06x,0x%06x): %v", addr, addr+len(data), err)
+	}
+	_, wantCRC := xcrc32.NewCRC32(data)
+	_, gotCRC := xcrc32.NewCRC32(readBack)
+	if gotCRC != wantCRC {
+		return gotCRC, fmt.Errorf("read-back CRC mismatch: got=0x%08x want=0x%08x", gotCRC, wantCRC)
+	}
+	return gotCRC, nil
+}
+
+// reset waits to confirm that there is no output from the device
+// and then tries to issue a wake the SPI ROM command.
+func (a *QF) reset(resetAtStart bool) error {
+	if resetAtStart {
+		if _, err := a.spi([]byte{0x66}, 0); err != nil {
+			return fmt.Errorf("failed to enable reset: %v", err)
+		}
+		if _, err := a.spi([]byte{0x99}, 0); err != nil {
+			return fmt.Errorf("failed to reset device: %v", err)
+		}
+	}
+
+	// Awake the ROM.
+	if _, err := a.spi([]byte{0xAB}, 1); err != nil {
+		return err
+	}
+	// Read device information
+	b, err := a.spi([]byte{0x9F}, 3)
+	if err != nil {
+		return err
+	}
+
+	if b[0] != 0xC8 {
+		return fmt.Errorf("got MID=0x%02X expected MID=0xC8", b[0])
+	}
+	if b[1] != 0x40 || b[2] != 0x15 {
+		return fmt.Errorf("got DID=0x%02X,0x%02X expect 0x40,0x15", b[1], b[2])
+	}
+
+	if a.Debug {
+		log.Printf("QuickFeather: MID=0x%02X, DID=0x%02X,0x%02X\n", b[0], b[1], b[2])
+	}
+	if err := a.await(0, 0, time.Second); err != nil {
+		return fmt.Errorf("failed to read status: %v", err)
+	}
+	if _, err := a.Read(0, 16, false); err != nil {
+		log.Println("failed to read first 16 bytes:", err)
+	}
+
+	return nil
+}
+
+// NewQF opens a connection to a QuickFeather via the specified tty
+// device file. resetAtStart causes the device to be reset before the
+// SPI ROM is woken up; latency is how long to wait for the device to
+// reach a desired status before giving up. pipelineDepth bounds how
+// many fast-read SPI commands Read batches into a single USB write;
+// it has no effect on writes, which must poll WIP between each
+// page-program. A value below 1 falls back to defaultPipelineDepth.
+func NewQF(tty string, resetAtStart, debug bool, latency time.Duration, pipelineDepth int) (*QF, error) {
+	if pipelineDepth < 1 {
+		pipelineDepth = defaultPipelineDepth
+	}
+	t, err := term.Open(tty, term.Speed(115200), term.RawMode)
+	if err != nil {
+		return nil, fmt.Errorf("unable to open serial port: %v", err)
+	}
+	a := &QF{
+		t:             t,
+		closer:        t,
+		reader:        bufio.NewReader(t),
+		Latency:       latency,
+		Debug:         debug,
+		PipelineDepth: pipelineDepth,
+	}
+	if err := a.reset(resetAtStart); err != nil {
+		a.Close()
+		return nil, err
+	}
+	return a, nil
+}
+
+// ReadMeta reads the meta data and decodes it from the specified section.
+func (a *QF) ReadMeta(sec Section) (MetaData, error) {
+	var decoded MetaData
+	m, err := a.Read(sec.Meta, binary.Size(decoded), false)
+	if err != nil {
+		return decoded, fmt.Errorf("failed to read %d bytes of meta data from sector %q: %v", binary.Size(decoded), sec.Name, err)
+	}
+	if err := binary.Read(bytes.NewReader(m), binary.LittleEndian, &decoded); err != nil {
+		return decoded, fmt.Errorf("failed to decode metadata for %q: %v", sec.Name, err)
+	}
+	return decoded, nil
+}
+
+// WriteMeta writes the metadata for a section to the flash.
+// Protection checking should be performed prior to calling this
+// function.
+func (a *QF) WriteMeta(sec Section, m MetaData) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, m); err != nil {
+		return fmt.Errorf("failed to format metadata for %q: %v", sec.Name, err)
+	}
+	if len(buf.Bytes()) != 12 {
+		return fmt.Errorf("programming error with metadata for %q: %d and not 12 bytes", sec.Name, len(buf.Bytes()))
+	}
+	if err := a.Write(sec.Meta, buf.Bytes(), false); err != nil {
+		return fmt.Errorf("failed to write metadata for %q: %v", sec.Name, err)
+	}
+	return nil
+}
+
+// Validate attempts to confirm the CRC of the named section.
+func (a *QF) Validate(name string) error {
+	sec, err := SectionByName(name)
+	if err != nil {
+		return err
+	}
+	meta, err := a.ReadMeta(sec)
+	if err != nil {
+		return err
+	}
+	if max := sec.Limit - sec.Base; meta.Size > uint32(max) {
+		return fmt.Errorf("meta for %q has invalid size %d > %d", sec.Name, meta.Size, max)
+	}
+	d, err := a.Read(sec.Base, int(meta.Size), true)
+	if err != nil {
+		return fmt.Errorf("failed to read %q (size %d bytes): %v", sec.Name, meta.Size, err)
+	}
+	_, crc := xcrc32.NewCRC32(d)
+	if crc == meta.CRC {
+		return nil
+	}
+	return fmt.Errorf("crc mismatch for %q: got=0x%08x want=0x%08x", sec.Name, crc, meta.CRC)
+}
+
+// ReadManifest reads and decodes the A/B boot manifest.
+func (a *QF) ReadManifest() (BootManifest, error) {
+	var m BootManifest
+	b, err := a.Read(BootManifestAddr, binary.Size(m), false)
+	if err != nil {
+		return m, fmt.Errorf("failed to read boot manifest: %v", err)
+	}
+	if err := binary.Read(bytes.NewReader(b), binary.LittleEndian, &m); err != nil {
+		return m, fmt.Errorf("failed to decode boot manifest: %v", err)
+	}
+	return m, nil
+}
+
+// WriteManifest rewrites the A/B boot manifest.
+func (a *QF) WriteManifest(m BootManifest) error {
+	buf := new(bytes.Buffer)
+	if err := binary.Write(buf, binary.LittleEndian, m); err != nil {
+		return fmt.Errorf("failed to format boot manifest: %v", err)
+	}
+	if err := a.Write(BootManifestAddr, buf.Bytes(), false); err != nil {
+		return fmt.Errorf("failed to write boot manifest: %v", err)
+	}
+	return nil
+}
+
+// OTAActive returns the slot the boot manifest currently treats as
+// active, defaulting to SlotA for a never-initialized manifest since
+// that range coincides with the legacy single "app" section.
+func OTAActive(m BootManifest) uint8 {
+	if m.Active != SlotA && m.Active != SlotB {
+		return SlotA
+	}
+	return m.Active
+}
+
+// OTAWriteImage programs data into the OTA slot that is not
+// currently active, verifies the write by reading it back, and
+// flips the manifest's pending byte so the bootloader picks it up
+// as a candidate. The active slot is never chosen as that target:
+// force does not waive a refusal (there is nothing to refuse, since
+// the inactive slot by construction can never be the active one),
+// it instead redirects the write to the active slot directly,
+// skipping the pending/version bookkeeping since there is no A/B
+// transition to record. This is for recovery use only, e.g.
+// repairing a corrupt active image that has no usable alternate.
+func (a *QF) OTAWriteImage(data []byte, force, ticker bool) error {
+	m, err := a.ReadManifest()
+	if err != nil {
+		return err
+	}
+	active := OTAActive(m)
+	inactive := SlotB
+	if active == SlotB {
+		inactive = SlotA
+	}
+	writeSlot := inactive
+	if force {
+		writeSlot = active
+	}
+	target := OTASlots[writeSlot]
+
+	if len(data) > target.Limit-target.Base {
+		return fmt.Errorf("image (%d bytes) is too large for slot %s (%d bytes)", len(data), target.Name, target.Limit-target.Base)
+	}
+	if err := a.Write(target.Base, data, ticker); err != nil {
+		return fmt.Errorf("failed to write slot %s: %v", target.Name, err)
+	}
+	crc, err := a.VerifyWrite(target.Base, data, ticker)
+	if err != nil {
+		return fmt.Errorf("slot %s: %v", target.Name, err)
+	}
+	if err := a.WriteMeta(target, MetaData{
+		CRC:      crc,
+		Size:     uint32(len(data)),
+		Written:  PresentWritten,
+		Image:    target.Image,
+		Purpose:  target.Purpose,
+		Reserved: 0xff,
+	}); err != nil {
+		return err
+	}
+	if force {
+		return nil
+	}
+
+	m.Active = active
+	m.Version++
+	m.Pending = inactive
+	return a.WriteManifest(m)
+}
+
+// OTAConfirmSlot promotes the pending slot to active and resets the
+// boot-attempt counter.
+func (a *QF) OTAConfirmSlot() error {
+	m, err := a.ReadManifest()
+	if err != nil {
+		return err
+	}
+	if m.Pending != SlotA && m.Pending != SlotB {
+		return fmt.Errorf("no pending OTA slot to confirm")
+	}
+	m.Active = m.Pending
+	m.Pending = SlotNone
+	m.Attempts = MaxBootAttempts
+	return a.WriteManifest(m)
+}
+
+// OTARollbackSlot abandons an unconfirmed pending update, or, if
+// there is none in flight, falls back to the other slot and resets
+// the boot-attempt counter, mirroring what the bootloader itself
+// does once Attempts is exhausted.
+func (a *QF) OTARollbackSlot() error {
+	m, err := a.ReadManifest()
+	if err != nil {
+		return err
+	}
+	if m.Pending == SlotA || m.Pending == SlotB {
+		m.Pending = SlotNone
+		return a.WriteManifest(m)
+	}
+	active := OTAActive(m)
+	other := SlotB
+	if active == SlotB {
+		other = SlotA
+	}
+	m.Active = other
+	m.Pending = SlotNone
+	m.Attempts = MaxBootAttempts
+	return a.WriteManifest(m)
+}
@@ -0,0 +1,187 @@
+package qflash
+
+import (
+	"fmt"
+	"testing"
+	"time"
+)
+
+// mockTransport is a minimal software model of the TinyFPGA-bootloader
+// protocol plus an MX25-like SPI NOR flash, used to drive Read/
+// ProgramBytes/EraseSector without real hardware. It enforces the two
+// invariants that matter for correctness: WREN only takes effect when
+// the flash is not already mid-program/erase (WIP=1), and a
+// page-program or sector-erase is silently ignored unless WEL is set,
+// exactly like real MX25 parts.
+type mockTransport struct {
+	flash   []byte
+	wel     bool
+	busyFor int // remaining status polls that still report WIP=1
+	pending []byte
+}
+
+func newMockTransport(size int) *mockTransport {
+	m := &mockTransport{flash: make([]byte, size)}
+	for i := range m.flash {
+		m.flash[i] = 0xff
+	}
+	return m
+}
+
+// busyPolls is how many RDSR reads a program/erase stays busy for
+// before WIP clears, modeling a realistic chip that does not
+// complete within the same command as it was issued.
+const busyPolls = 2
+
+func (m *mockTransport) exec(cmd []byte, expect int) []byte {
+	switch cmd[0] {
+	case 0x06: // WREN
+		if m.busyFor == 0 {
+			m.wel = true
+		}
+		return nil
+	case 0x05: // RDSR
+		status := byte(0)
+		if m.busyFor > 0 {
+			m.busyFor--
+			status = flashWIP
+		}
+		return []byte{status}
+	case 0x02: // page program
+		if !m.wel || m.busyFor > 0 {
+			return nil // WEL unset or chip still busy: command is dropped
+		}
+		addr := int(cmd[1])<<16 | int(cmd[2])<<8 | int(cmd[3])
+		copy(m.flash[addr:], cmd[4:])
+		m.wel = false
+		m.busyFor = busyPolls
+		return nil
+	case 0x20: // sector erase
+		if !m.wel || m.busyFor > 0 {
+			return nil
+		}
+		addr := int(cmd[1])<<16 | int(cmd[2])<<8 | int(cmd[3])
+		for i := 0; i < 0x1000; i++ {
+			m.flash[addr+i] = 0xff
+		}
+		m.wel = false
+		m.busyFor = busyPolls
+		return nil
+	case 0x0B: // fast read
+		addr := int(cmd[1])<<16 | int(cmd[2])<<8 | int(cmd[3])
+		return append([]byte{}, m.flash[addr:addr+expect]...)
+	default:
+		return make([]byte, expect)
+	}
+}
+
+func (m *mockTransport) Write(p []byte) (int, error) {
+	off := 0
+	for off < len(p) {
+		if p[off] != 1 {
+			return 0, fmt.Errorf("mock: unexpected request byte 0x%02x", p[off])
+		}
+		send := int(p[off+1]) | int(p[off+2])<<8
+		expect := int(p[off+3]) | int(p[off+4])<<8
+		off += 5
+		cmd := p[off : off+send]
+		off += send
+		m.pending = append(m.pending, m.exec(cmd, expect)...)
+	}
+	return len(p), nil
+}
+
+func (m *mockTransport) Read(p []byte) (int, error) {
+	n := copy(p, m.pending)
+	m.pending = m.pending[n:]
+	return n, nil
+}
+
+// mockLatency bounds how long await() retries waiting for the mock's
+// simulated WIP to clear; it only needs to be long enough to cover
+// busyPolls retries at await's 10ms poll interval, not real hardware
+// latency.
+const mockLatency = 100 * time.Millisecond
+
+func newMockQF(size, pipelineDepth int) (*QF, *mockTransport) {
+	t := newMockTransport(size)
+	return &QF{t: t, PipelineDepth: pipelineDepth, Latency: mockLatency}, t
+}
+
+// TestProgramBytesWithBusyFlash exercises the regression the pipelined
+// rewrite of ProgramBytes introduced: batching several WREN+program
+// pairs ahead of a single aggregate status poll drops every program
+// after the first, since real (and mocked, here) MX25 flash ignores
+// WREN while WIP=1. With a mock that models WIP clearing a couple of
+// polls after each program, every byte of a multi-chunk write must
+// still land.
+func TestProgramBytesWithBusyFlash(t *testing.T) {
+	a, mock := newMockQF(RomSize, 8)
+	data := make([]byte, 64)
+	for i := range data {
+		data[i] = byte(i + 1)
+	}
+	if err := a.ProgramBytes(0x1000, data, false); err != nil {
+		t.Fatalf("ProgramBytes: %v", err)
+	}
+	got := mock.flash[0x1000 : 0x1000+len(data)]
+	for i, b := range got {
+		if b != data[i] {
+			t.Fatalf("byte %d: got 0x%02x, want 0x%02x (rest of write was dropped)", i, b, data[i])
+		}
+	}
+}
+
+func mibPerSec(b *testing.B, n int) float64 {
+	return float64(n) / (1024 * 1024) / b.Elapsed().Seconds()
+}
+
+// BenchmarkRead reports MiB/s for Read with pipelined fast-read
+// commands on a mocked transport.
+func BenchmarkRead(b *testing.B) {
+	a, _ := newMockQF(RomSize, 8)
+	const n = 0x4000
+	b.SetBytes(n)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := a.Read(0, n, false); err != nil {
+			b.Fatalf("Read: %v", err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(mibPerSec(b, n*b.N), "MiB/s")
+}
+
+// BenchmarkEraseSector reports MiB/s for repeated sector erases on a
+// mocked transport.
+func BenchmarkEraseSector(b *testing.B) {
+	a, _ := newMockQF(RomSize, 8)
+	b.SetBytes(0x1000)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := a.EraseSector(0x1000); err != nil {
+			b.Fatalf("EraseSector: %v", err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(mibPerSec(b, 0x1000*b.N), "MiB/s")
+}
+
+// BenchmarkProgramBytes reports MiB/s for ProgramBytes on a mocked,
+// pre-erased transport.
+func BenchmarkProgramBytes(b *testing.B) {
+	a, _ := newMockQF(RomSize, 8)
+	data := make([]byte, 0x1000)
+	for i := range data {
+		data[i] = byte(i)
+	}
+	b.SetBytes(int64(len(data)))
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := a.ProgramBytes(0x1000, data, false); err != nil {
+			b.Fatalf("ProgramBytes: %v", err)
+		}
+	}
+	b.StopTimer()
+	b.ReportMetric(mibPerSec(b, len(data)*b.N), "MiB/s")
+}